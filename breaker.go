@@ -0,0 +1,102 @@
+package freesia
+
+import (
+	"sync"
+	"time"
+
+	"github.com/sony/gobreaker"
+	"github.com/xiaojiaoyu100/freesia/entry"
+)
+
+// WithBreaker installs a circuit breaker in front of the remote store.
+// Once consecutiveFailures store errors in a row trip it, it stays open
+// for cooldown before allowing a half-open probe. While open, Get falls
+// back to stale-but-present local-cache entries (see entry.WithStaleFor),
+// and Set/Del queue into a write-back buffer, replayed once the breaker
+// closes again. The buffer holds at most bufferSize pending Sets and,
+// separately, at most bufferSize pending deleted keys; anything beyond
+// that is dropped.
+func WithBreaker(consecutiveFailures uint32, cooldown time.Duration, bufferSize int) Setter {
+	return func(f *Freesia) error {
+		f.breaker = gobreaker.NewCircuitBreaker(gobreaker.Settings{
+			Name:    "freesia",
+			Timeout: cooldown,
+			ReadyToTrip: func(counts gobreaker.Counts) bool {
+				return counts.ConsecutiveFailures >= consecutiveFailures
+			},
+		})
+		f.writeBack = newWriteBackBuffer(bufferSize)
+		return nil
+	}
+}
+
+// Health reports the state of the circuit breaker guarding the remote
+// store. A Freesia built without WithBreaker always reports
+// gobreaker.StateClosed.
+func (f *Freesia) Health() gobreaker.State {
+	if f.breaker == nil {
+		return gobreaker.StateClosed
+	}
+	return f.breaker.State()
+}
+
+func (f *Freesia) breakerOpen() bool {
+	return f.breaker != nil && f.breaker.State() != gobreaker.StateClosed
+}
+
+// storeResult carries a redis.Nil miss through the breaker without
+// counting it as a store failure.
+type storeResult struct {
+	data []byte
+	miss bool
+}
+
+func (f *Freesia) storeExec(fn func() (interface{}, error)) (interface{}, error) {
+	if f.breaker == nil {
+		return fn()
+	}
+	return f.breaker.Execute(fn)
+}
+
+// writeBackBuffer holds the Set/Del calls Freesia couldn't make while
+// the breaker was open, so they can be replayed once it closes.
+type writeBackBuffer struct {
+	mu      sync.Mutex
+	sets    []*entry.Entry
+	dels    []string
+	maxSize int
+}
+
+func newWriteBackBuffer(maxSize int) *writeBackBuffer {
+	return &writeBackBuffer{maxSize: maxSize}
+}
+
+func (b *writeBackBuffer) queueSet(e *entry.Entry) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.sets) >= b.maxSize {
+		return
+	}
+	b.sets = append(b.sets, e)
+}
+
+func (b *writeBackBuffer) queueDel(keys ...string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	room := b.maxSize - len(b.dels)
+	if room <= 0 {
+		return
+	}
+	if len(keys) > room {
+		keys = keys[:room]
+	}
+	b.dels = append(b.dels, keys...)
+}
+
+func (b *writeBackBuffer) drain() ([]*entry.Entry, []string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	sets, dels := b.sets, b.dels
+	b.sets, b.dels = nil, nil
+	return sets, dels
+}
@@ -0,0 +1,12 @@
+package freesia
+
+import "github.com/xiaojiaoyu100/freesia/codec"
+
+// WithCodec sets the default Codec entries use when they haven't
+// selected one of their own via entry.WithCodec.
+func WithCodec(c codec.Codec) Setter {
+	return func(f *Freesia) error {
+		f.defaultCodec = c
+		return nil
+	}
+}
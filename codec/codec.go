@@ -0,0 +1,9 @@
+// Package codec defines the pluggable value serialization Freesia uses
+// when writing entries to the store.
+package codec
+
+// Codec marshals and unmarshals the values Freesia stores.
+type Codec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(b []byte, v interface{}) error
+}
@@ -0,0 +1,49 @@
+package codec
+
+import (
+	"bytes"
+	"io/ioutil"
+
+	"github.com/golang/snappy"
+	"github.com/pierrec/lz4"
+)
+
+// Compressor compresses and decompresses already-marshaled payloads.
+type Compressor interface {
+	Compress(b []byte) ([]byte, error)
+	Decompress(b []byte) ([]byte, error)
+}
+
+type snappyCompressor struct{}
+
+// Snappy is a low-latency, low-ratio Compressor.
+var Snappy Compressor = snappyCompressor{}
+
+func (snappyCompressor) Compress(b []byte) ([]byte, error) {
+	return snappy.Encode(nil, b), nil
+}
+
+func (snappyCompressor) Decompress(b []byte) ([]byte, error) {
+	return snappy.Decode(nil, b)
+}
+
+type lz4Compressor struct{}
+
+// LZ4 is a higher-ratio Compressor than Snappy, at extra CPU cost.
+var LZ4 Compressor = lz4Compressor{}
+
+func (lz4Compressor) Compress(b []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := lz4.NewWriter(&buf)
+	if _, err := w.Write(b); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (lz4Compressor) Decompress(b []byte) ([]byte, error) {
+	return ioutil.ReadAll(lz4.NewReader(bytes.NewReader(b)))
+}
@@ -0,0 +1,23 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/gob"
+)
+
+type gobCodec struct{}
+
+// Gob is a Codec built on encoding/gob.
+var Gob Codec = gobCodec{}
+
+func (gobCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(b []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(b)).Decode(v)
+}
@@ -0,0 +1,17 @@
+package codec
+
+import "encoding/json"
+
+type jsonCodec struct{}
+
+// JSON is a human-readable Codec, handy for values that need to stay
+// inspectable in Redis.
+var JSON Codec = jsonCodec{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(b []byte, v interface{}) error {
+	return json.Unmarshal(b, v)
+}
@@ -0,0 +1,16 @@
+package codec
+
+import "github.com/vmihailenco/msgpack"
+
+type msgpackCodec struct{}
+
+// Msgpack is Freesia's original, default Codec.
+var Msgpack Codec = msgpackCodec{}
+
+func (msgpackCodec) Marshal(v interface{}) ([]byte, error) {
+	return msgpack.Marshal(v)
+}
+
+func (msgpackCodec) Unmarshal(b []byte, v interface{}) error {
+	return msgpack.Unmarshal(b, v)
+}
@@ -0,0 +1,28 @@
+package codec
+
+import (
+	"errors"
+
+	"github.com/golang/protobuf/proto"
+)
+
+type protobufCodec struct{}
+
+// Protobuf is a Codec for values implementing proto.Message.
+var Protobuf Codec = protobufCodec{}
+
+func (protobufCodec) Marshal(v interface{}) ([]byte, error) {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return nil, errors.New("codec: value does not implement proto.Message")
+	}
+	return proto.Marshal(m)
+}
+
+func (protobufCodec) Unmarshal(b []byte, v interface{}) error {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return errors.New("codec: value does not implement proto.Message")
+	}
+	return proto.Unmarshal(b, m)
+}
@@ -0,0 +1,248 @@
+// Package entry defines the unit of data Freesia moves between the
+// local cache and the remote store.
+package entry
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/xiaojiaoyu100/freesia/codec"
+)
+
+// frameMagic prefixes a framed payload. It can't be mistaken for a
+// legacy raw msgpack payload: msgpack never emits 0xc1 as a leading
+// byte, whereas 0x80-0xff is already spoken for by fixmap, fixstr,
+// nil/bool and negative fixint, the shapes vmihailenco encodes structs
+// and strings as.
+const frameMagic byte = 0xc1
+
+var codecIDs = map[codec.Codec]byte{
+	codec.Msgpack:  0,
+	codec.JSON:     1,
+	codec.Gob:      2,
+	codec.Protobuf: 3,
+}
+
+var codecsByID = map[byte]codec.Codec{
+	0: codec.Msgpack,
+	1: codec.JSON,
+	2: codec.Gob,
+	3: codec.Protobuf,
+}
+
+var compressorIDs = map[codec.Compressor]byte{
+	codec.Snappy: 1,
+	codec.LZ4:    2,
+}
+
+var compressorsByID = map[byte]codec.Compressor{
+	1: codec.Snappy,
+	2: codec.LZ4,
+}
+
+// frameHeader returns the two-byte header Encode prefixes framed
+// payloads with: the frameMagic sentinel, followed by a byte packing
+// the codec and compressor ids.
+func frameHeader(codecID, compressorID byte) [2]byte {
+	return [2]byte{frameMagic, codecID<<4 | compressorID<<2}
+}
+
+// parseFrameHeader reports whether b starts with a frame header and, if
+// so, the codec/compressor ids it carries.
+func parseFrameHeader(b []byte) (codecID, compressorID byte, ok bool) {
+	if len(b) < 2 || b[0] != frameMagic {
+		return 0, 0, false
+	}
+	packed := b[1]
+	return (packed >> 4) & 0x7, (packed >> 2) & 0x3, true
+}
+
+// Loader synchronously produces the value for an Entry on a cache miss,
+// so Freesia can repopulate the store in place of returning redis.Nil.
+type Loader func(ctx context.Context) (interface{}, error)
+
+// Entry represents a single cache item flowing through Freesia.
+type Entry struct {
+	Key        string
+	Value      interface{}
+	Expiration time.Duration
+
+	data             []byte
+	enableLocalCache bool
+	loader           Loader
+	staleFor         time.Duration
+	codec            codec.Codec
+	compressor       codec.Compressor
+	compressAt       int
+	tags             []string
+}
+
+// Option configures an Entry at construction time.
+type Option func(*Entry)
+
+// New creates an Entry for the given key/value pair.
+func New(key string, value interface{}, expiration time.Duration, opts ...Option) *Entry {
+	e := &Entry{
+		Key:        key,
+		Value:      value,
+		Expiration: expiration,
+	}
+	for _, opt := range opts {
+		opt(e)
+	}
+	return e
+}
+
+// WithLocalCache enables the local in-process cache for this entry.
+func WithLocalCache() Option {
+	return func(e *Entry) {
+		e.enableLocalCache = true
+	}
+}
+
+// EnableLocalCache reports whether this entry should be mirrored into
+// the local cache in addition to the remote store.
+func (e *Entry) EnableLocalCache() bool {
+	return e.enableLocalCache
+}
+
+// WithLoader attaches a loader Freesia can call to repopulate the entry
+// synchronously on a cache miss, instead of returning redis.Nil.
+func WithLoader(loader Loader) Option {
+	return func(e *Entry) {
+		e.loader = loader
+	}
+}
+
+// HasLoader reports whether this entry carries a Loader.
+func (e *Entry) HasLoader() bool {
+	return e.loader != nil
+}
+
+// Load invokes the entry's Loader.
+func (e *Entry) Load(ctx context.Context) (interface{}, error) {
+	return e.loader(ctx)
+}
+
+// WithStaleFor allows this entry to be served from the local cache for
+// up to d past its normal Expiration while the remote store is
+// unavailable.
+func WithStaleFor(d time.Duration) Option {
+	return func(e *Entry) {
+		e.staleFor = d
+	}
+}
+
+// StaleFor returns how long past Expiration this entry may still be
+// served from the local cache during a store outage.
+func (e *Entry) StaleFor() time.Duration {
+	return e.staleFor
+}
+
+// WithTags associates this entry with one or more tags, so it can later
+// be invalidated by Freesia.InvalidateTag without knowing its key.
+func WithTags(tags ...string) Option {
+	return func(e *Entry) {
+		e.tags = tags
+	}
+}
+
+// Tags returns the tags this entry was set with.
+func (e *Entry) Tags() []string {
+	return e.tags
+}
+
+// WithCodec selects a non-default Codec for this entry's wire payload.
+func WithCodec(c codec.Codec) Option {
+	return func(e *Entry) {
+		e.codec = c
+	}
+}
+
+// SetCodec assigns c to this entry if it hasn't already picked one via
+// WithCodec, letting Freesia apply a store-wide default.
+func (e *Entry) SetCodec(c codec.Codec) {
+	if e.codec == nil {
+		e.codec = c
+	}
+}
+
+// WithCompression compresses this entry's encoded payload via c once it
+// reaches threshold bytes.
+func WithCompression(c codec.Compressor, threshold int) Option {
+	return func(e *Entry) {
+		e.compressor = c
+		e.compressAt = threshold
+	}
+}
+
+func (e *Entry) activeCodec() codec.Codec {
+	if e.codec != nil {
+		return e.codec
+	}
+	return codec.Msgpack
+}
+
+// Encode serializes Value into the entry's wire representation,
+// compressing it first if a Compressor was configured and the encoded
+// size reaches the configured threshold.
+func (e *Entry) Encode() error {
+	c := e.activeCodec()
+	payload, err := c.Marshal(e.Value)
+	if err != nil {
+		return err
+	}
+	var compressorID byte
+	if e.compressor != nil && len(payload) >= e.compressAt {
+		compressed, err := e.compressor.Compress(payload)
+		if err != nil {
+			return err
+		}
+		payload = compressed
+		compressorID = compressorIDs[e.compressor]
+	}
+	header := frameHeader(codecIDs[c], compressorID)
+	e.data = append([]byte{header[0], header[1]}, payload...)
+	return nil
+}
+
+// Decode deserializes b into Value. It understands the codec+compression
+// framing header written by Encode, and falls back to treating b as a
+// raw msgpack payload when the header is absent, so values written
+// before this framing existed still decode correctly.
+func (e *Entry) Decode(b []byte) error {
+	c := e.activeCodec()
+	payload := b
+	if len(b) > 0 {
+		if codecID, compressorID, ok := parseFrameHeader(b); ok {
+			if known, exists := codecsByID[codecID]; exists {
+				c = known
+			}
+			payload = b[2:]
+			if compressorID != 0 {
+				decompressor, exists := compressorsByID[compressorID]
+				if !exists {
+					return errors.Errorf("entry: unknown compressor id %d", compressorID)
+				}
+				decompressed, err := decompressor.Decompress(payload)
+				if err != nil {
+					return err
+				}
+				payload = decompressed
+			}
+		} else {
+			c = codec.Msgpack
+		}
+	}
+	if err := c.Unmarshal(payload, e.Value); err != nil {
+		return err
+	}
+	e.data = b
+	return nil
+}
+
+// Data returns the bytes produced by the most recent Encode/Decode call.
+func (e *Entry) Data() []byte {
+	return e.data
+}
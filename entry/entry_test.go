@@ -0,0 +1,84 @@
+package entry
+
+import (
+	"testing"
+	"time"
+
+	"github.com/vmihailenco/msgpack"
+	"github.com/xiaojiaoyu100/freesia/codec"
+)
+
+func TestEncodeDecodeRoundTrip(t *testing.T) {
+	in := New("k", map[string]string{"a": "b"}, time.Minute)
+	if err := in.Encode(); err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+
+	out := &Entry{Value: &map[string]string{}}
+	if err := out.Decode(in.Data()); err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	got := *out.Value.(*map[string]string)
+	if got["a"] != "b" {
+		t.Fatalf("got %v, want a=b", got)
+	}
+}
+
+func TestEncodeDecodeRoundTripWithCompression(t *testing.T) {
+	in := New("k", "a value long enough to cross the compression threshold", time.Minute,
+		WithCodec(codec.JSON), WithCompression(codec.Snappy, 1))
+	if err := in.Encode(); err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+
+	var got string
+	out := &Entry{Value: &got}
+	if err := out.Decode(in.Data()); err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	if got != "a value long enough to cross the compression threshold" {
+		t.Fatalf("got %q", got)
+	}
+}
+
+// TestDecodeLegacyPayload covers values written before the framing
+// header existed: raw msgpack with no frameMagic prefix. The leading
+// bytes exercised here and in TestDecodeLegacyString (fixmap, fixstr)
+// previously collided with the old bit-flag framing scheme.
+func TestDecodeLegacyPayload(t *testing.T) {
+	legacy, err := msgpack.Marshal(map[string]string{"a": "b"})
+	if err != nil {
+		t.Fatalf("msgpack.Marshal: %v", err)
+	}
+	if legacy[0] != 0x81 {
+		t.Fatalf("test payload must start with a fixmap byte, got %#x", legacy[0])
+	}
+
+	out := &Entry{Value: &map[string]string{}}
+	if err := out.Decode(legacy); err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	got := *out.Value.(*map[string]string)
+	if got["a"] != "b" {
+		t.Fatalf("got %v, want a=b", got)
+	}
+}
+
+func TestDecodeLegacyString(t *testing.T) {
+	legacy, err := msgpack.Marshal("hello")
+	if err != nil {
+		t.Fatalf("msgpack.Marshal: %v", err)
+	}
+	if legacy[0]&0xe0 != 0xa0 {
+		t.Fatalf("test payload must start with a fixstr byte, got %#x", legacy[0])
+	}
+
+	var got string
+	out := &Entry{Value: &got}
+	if err := out.Decode(legacy); err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	if got != "hello" {
+		t.Fatalf("got %q, want hello", got)
+	}
+}
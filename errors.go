@@ -0,0 +1,44 @@
+package freesia
+
+import "fmt"
+
+// Layer identifies which part of Freesia an Error originated in, so
+// callers can distinguish e.g. a decode failure from a store timeout
+// without string-matching the error message.
+type Layer string
+
+const (
+	// LayerLocal covers the in-process cache and value encode/decode.
+	LayerLocal Layer = "local"
+	// LayerStore covers the remote redis store.
+	LayerStore Layer = "store"
+	// LayerPubsub covers the local-cache invalidation subscriber.
+	LayerPubsub Layer = "pubsub"
+)
+
+// Error is Freesia's structured error type.
+type Error struct {
+	Op    string
+	Key   string
+	Layer Layer
+	Err   error
+}
+
+func (e *Error) Error() string {
+	if e.Key == "" {
+		return fmt.Sprintf("freesia: %s: layer=%s: %v", e.Op, e.Layer, e.Err)
+	}
+	return fmt.Sprintf("freesia: %s: layer=%s key=%s: %v", e.Op, e.Layer, e.Key, e.Err)
+}
+
+// Unwrap allows Error to participate in errors.Is/errors.As chains.
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func newError(op, key string, layer Layer, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &Error{Op: op, Key: key, Layer: layer, Err: err}
+}
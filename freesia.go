@@ -3,21 +3,43 @@ package freesia
 import (
 	"context"
 	"fmt"
+	"sync/atomic"
+	"time"
 
 	"github.com/xiaojiaoyu100/lizard/mass"
 
 	"github.com/go-redis/redis"
-	"github.com/pkg/errors"
-	"github.com/vmihailenco/msgpack"
+	"github.com/sony/gobreaker"
 	"github.com/xiaojiaoyu100/curlew"
+	"github.com/xiaojiaoyu100/freesia/codec"
 	"github.com/xiaojiaoyu100/freesia/entry"
 	"github.com/xiaojiaoyu100/roc"
+	"golang.org/x/sync/singleflight"
 )
 
+// channel is the pubsub channel used to broadcast local cache invalidations.
+const channel = "freesia:invalidate"
+
+// asyncFillTimeout bounds the back-fill job submitted to the dispatcher
+// on a cache miss, so it cannot outlive the caller indefinitely just
+// because it runs detached on the shared dispatcher.
+const asyncFillTimeout = 5 * time.Second
+
 type Freesia struct {
 	store      Store
 	cache      *roc.Cache
 	dispatcher *curlew.Dispatcher
+	fillGroup  singleflight.Group
+
+	// asyncFillDepth counts jobs submitted to the dispatcher via
+	// submitFill that haven't finished yet, reported through
+	// Metrics.AsyncFillQueueDepth.
+	asyncFillDepth int64
+
+	breaker      *gobreaker.CircuitBreaker
+	writeBack    *writeBackBuffer
+	defaultCodec codec.Codec
+	metrics      Metrics
 }
 
 func New(store Store, setters ...Setter) (*Freesia, error) {
@@ -32,13 +54,19 @@ func New(store Store, setters ...Setter) (*Freesia, error) {
 		}
 	}
 
+	if f.metrics == nil {
+		f.metrics = noopMetrics{}
+	}
+
 	cache, err := roc.New()
 	if err != nil {
 		return nil, err
 	}
 	f.cache = cache
 
-	monitor := func(err error) {}
+	monitor := func(err error) {
+		f.metrics.Error(newError("dispatch", "", LayerStore, err))
+	}
 	f.dispatcher, err = curlew.New(curlew.WithMonitor(monitor))
 	if err != nil {
 		return nil, err
@@ -46,41 +74,104 @@ func New(store Store, setters ...Setter) (*Freesia, error) {
 
 	f.sub()
 
+	if f.writeBack != nil {
+		f.drainWriteBack()
+	}
+
 	return f, nil
 }
 
 func (f *Freesia) Set(e *entry.Entry) error {
+	return f.SetContext(context.Background(), e)
+}
+
+func (f *Freesia) SetContext(ctx context.Context, e *entry.Entry) error {
+	ctx, span := startSpan(ctx, "Set", e.Key)
+	start := time.Now()
+	err := f.set(ctx, e)
+	f.metrics.SetLatency(time.Since(start).Seconds())
+	endSpan(span, err)
+	return err
+}
+
+func (f *Freesia) set(ctx context.Context, e *entry.Entry) error {
+	if f.defaultCodec != nil {
+		e.SetCodec(f.defaultCodec)
+	}
 	if err := e.Encode(); err != nil {
-		return errors.Wrapf(err, "encode key = %s, value = %+v", e.Key, e.Value)
+		return newError("Set", e.Key, LayerLocal, err)
 	}
-	if err := f.store.Set(e.Key, e.Data(), e.Expiration).Err(); err != nil {
-		return errors.Wrapf(err, "store set key = %s, value = %+v", e.Key, e.Value)
+	if f.writeBack != nil && f.breakerOpen() {
+		f.writeBack.queueSet(e)
+	} else {
+		_, err := f.storeExec(func() (interface{}, error) {
+			return nil, f.store.WithContext(ctx).Set(e.Key, e.Data(), e.Expiration).Err()
+		})
+		if err != nil {
+			if f.writeBack == nil {
+				return newError("Set", e.Key, LayerStore, err)
+			}
+			f.writeBack.queueSet(e)
+		} else if err := f.registerTags(ctx, e); err != nil {
+			return err
+		}
 	}
 	if e.EnableLocalCache() {
-		if err := f.cache.Set(e.Key, e.Data(), e.Expiration/2); err != nil {
-			return errors.Wrapf(err, "cache set key = %s, value = %+v", e.Key, e.Value)
+		ttl := e.Expiration / 2
+		if e.StaleFor() > 0 {
+			ttl = e.Expiration + e.StaleFor()
+		}
+		if err := f.cache.Set(e.Key, e.Data(), ttl); err != nil {
+			return newError("Set", e.Key, LayerLocal, err)
 		}
 	}
 	return nil
 }
 
 func (f *Freesia) MSet(es ...*entry.Entry) error {
-	pipe := f.store.Pipeline()
+	return f.MSetContext(context.Background(), es...)
+}
+
+func (f *Freesia) MSetContext(ctx context.Context, es ...*entry.Entry) error {
+	keys := make([]string, len(es))
+	for i, e := range es {
+		keys[i] = e.Key
+	}
+	ctx, span := startSpan(ctx, "MSet", keys...)
+	err := f.mset(ctx, es...)
+	endSpan(span, err)
+	return err
+}
+
+func (f *Freesia) mset(ctx context.Context, es ...*entry.Entry) error {
+	f.metrics.PipelineSize(len(es))
+	pipe := f.store.WithContext(ctx).Pipeline()
 	for _, e := range es {
+		if f.defaultCodec != nil {
+			e.SetCodec(f.defaultCodec)
+		}
 		if err := e.Encode(); err != nil {
-			return errors.Wrapf(err, "encode key = %s, value = %+v", e.Key, e.Value)
+			return newError("MSet", e.Key, LayerLocal, err)
 		}
 		pipe.Set(e.Key, e.Data(), e.Expiration)
 	}
 	_, err := pipe.Exec()
 	if err != nil {
-		return errors.Wrapf(err, "pipeline exec")
+		return newError("MSet", "", LayerStore, err)
+	}
+	for _, e := range es {
+		if err := f.registerTags(ctx, e); err != nil {
+			return err
+		}
 	}
 	for _, e := range es {
 		if e.EnableLocalCache() {
-			err := f.cache.Set(e.Key, e.Data(), e.Expiration)
-			if err != nil {
-				return errors.Wrapf(err, "cache set key = %s, value = %+v", e.Key, e.Value)
+			ttl := e.Expiration / 2
+			if e.StaleFor() > 0 {
+				ttl = e.Expiration + e.StaleFor()
+			}
+			if err := f.cache.Set(e.Key, e.Data(), ttl); err != nil {
+				return newError("MSet", e.Key, LayerLocal, err)
 			}
 		}
 	}
@@ -88,43 +179,118 @@ func (f *Freesia) MSet(es ...*entry.Entry) error {
 }
 
 func (f *Freesia) Get(e *entry.Entry) error {
+	return f.GetContext(context.Background(), e)
+}
+
+func (f *Freesia) GetContext(ctx context.Context, e *entry.Entry) error {
+	ctx, span := startSpan(ctx, "Get", e.Key)
+	err := f.get(ctx, e)
+	endSpan(span, err)
+	return err
+}
+
+func (f *Freesia) get(ctx context.Context, e *entry.Entry) error {
+	if f.defaultCodec != nil {
+		e.SetCodec(f.defaultCodec)
+	}
 	if e.EnableLocalCache() {
 		data, err := f.cache.Get(e.Key)
 		if err == nil {
+			f.metrics.LocalHit(e.Key)
 			b, ok := data.([]byte)
 			if err := e.Decode(b); ok && err != nil {
-				return errors.Wrapf(err, "decode key = %s, data = %s", e.Key, b)
+				return newError("Get", e.Key, LayerLocal, err)
 			}
 			return nil
 		}
+		f.metrics.LocalMiss(e.Key)
 	}
-	b, err := f.store.Get(e.Key).Bytes()
-	switch err {
-	case redis.Nil:
-		j := curlew.NewJob()
-		j.Arg = e
-		j.Fn = func(ctx context.Context, arg interface{}) error {
-			return f.Set(arg.(*entry.Entry))
+	v, err := f.storeExec(func() (interface{}, error) {
+		b, gerr := f.store.WithContext(ctx).Get(e.Key).Bytes()
+		if gerr == redis.Nil {
+			return storeResult{miss: true}, nil
 		}
-		f.dispatcher.SubmitAsync(j)
-		return err
-	case nil:
-		err = e.Decode(b)
-		if err != nil {
-			return errors.Wrapf(err, "decode key = %s, data = %s", e.Key, b)
+		if gerr != nil {
+			return nil, gerr
+		}
+		return storeResult{data: b}, nil
+	})
+	if err != nil {
+		if f.breakerOpen() && e.StaleFor() > 0 {
+			if data, cerr := f.cache.Get(e.Key); cerr == nil {
+				if b, ok := data.([]byte); ok {
+					return e.Decode(b)
+				}
+			}
+		}
+		return newError("Get", e.Key, LayerStore, err)
+	}
+	res := v.(storeResult)
+	if res.miss {
+		f.metrics.StoreMiss(e.Key)
+		if e.HasLoader() {
+			return f.loadAndFill(ctx, e)
 		}
-	default:
-		return errors.Wrapf(err, "store get key = %s", e.Key)
+		f.submitFill(e)
+		return redis.Nil
 	}
+	f.metrics.StoreHit(e.Key)
+	if err := e.Decode(res.data); err != nil {
+		return newError("Get", e.Key, LayerLocal, err)
+	}
+
+	return nil
+}
+
+// submitFill asynchronously back-fills e on a cache miss. It runs on a
+// bounded child context rather than the caller's context, since the
+// caller may cancel (or return) long before the dispatcher gets around
+// to running the job.
+func (f *Freesia) submitFill(e *entry.Entry) {
+	ctx, cancel := context.WithTimeout(context.Background(), asyncFillTimeout)
+	j := curlew.NewJob()
+	j.Arg = e
+	j.Fn = func(_ context.Context, arg interface{}) error {
+		defer cancel()
+		defer f.metrics.AsyncFillQueueDepth(int(atomic.AddInt64(&f.asyncFillDepth, -1)))
+		return f.SetContext(ctx, arg.(*entry.Entry))
+	}
+	f.metrics.AsyncFillQueueDepth(int(atomic.AddInt64(&f.asyncFillDepth, 1)))
+	f.dispatcher.SubmitAsync(j)
+}
 
+// loadAndFill synchronously repopulates e via its Loader on a cache
+// miss. Concurrent misses for the same key coalesce into a single
+// Loader invocation, and the result is broadcast to every waiter,
+// which avoids a stampede of identical store writes under a popular
+// key expiring.
+func (f *Freesia) loadAndFill(ctx context.Context, e *entry.Entry) error {
+	v, err, _ := f.fillGroup.Do(e.Key, func() (interface{}, error) {
+		val, err := e.Load(ctx)
+		if err != nil {
+			return nil, err
+		}
+		e.Value = val
+		if err := f.SetContext(ctx, e); err != nil {
+			return nil, err
+		}
+		return val, nil
+	})
+	if err != nil {
+		return newError("Get", e.Key, LayerStore, err)
+	}
+	e.Value = v
 	return nil
 }
 
-func (f *Freesia) batchGet(es ...*entry.Entry) ([]*entry.Entry, error) {
-	pipe := f.store.Pipeline()
+func (f *Freesia) batchGet(ctx context.Context, es ...*entry.Entry) ([]*entry.Entry, error) {
+	pipe := f.store.WithContext(ctx).Pipeline()
 	found := make(map[*entry.Entry]struct{})
 	ret := make(map[*redis.StringCmd]*entry.Entry)
 	for _, e := range es {
+		if f.defaultCodec != nil {
+			e.SetCodec(f.defaultCodec)
+		}
 		if e.EnableLocalCache() {
 			b, err := f.cache.Get(e.Key)
 			if data, ok := b.([]byte); ok && err == nil {
@@ -154,12 +320,14 @@ func (f *Freesia) batchGet(es ...*entry.Entry) ([]*entry.Entry, error) {
 		b, err := cmd.Bytes()
 		switch err {
 		case redis.Nil:
-			j := curlew.NewJob()
-			j.Arg = e
-			j.Fn = func(ctx context.Context, arg interface{}) error {
-				return f.Set(arg.(*entry.Entry))
+			if e.HasLoader() {
+				if err := f.loadAndFill(ctx, e); err != nil {
+					return nil, err
+				}
+				found[e] = struct{}{}
+				continue
 			}
-			f.dispatcher.SubmitAsync(j)
+			f.submitFill(e)
 		case nil:
 			err = e.Decode(b)
 			if err != nil {
@@ -181,11 +349,26 @@ func (f *Freesia) batchGet(es ...*entry.Entry) ([]*entry.Entry, error) {
 }
 
 func (f *Freesia) MGet(es ...*entry.Entry) ([]*entry.Entry, error) {
+	return f.MGetContext(context.Background(), es...)
+}
+
+func (f *Freesia) MGetContext(ctx context.Context, es ...*entry.Entry) ([]*entry.Entry, error) {
+	keys := make([]string, len(es))
+	for i, e := range es {
+		keys[i] = e.Key
+	}
+	ctx, span := startSpan(ctx, "MGet", keys...)
+	missEntries, err := f.mget(ctx, es...)
+	endSpan(span, err)
+	return missEntries, err
+}
+
+func (f *Freesia) mget(ctx context.Context, es ...*entry.Entry) ([]*entry.Entry, error) {
 	batch := mass.New(len(es), 3000)
 	missEntries := make([]*entry.Entry, 0, len(es))
 	var start, length int
 	for batch.Iter(&start, &length) {
-		ee, err := f.batchGet(es[start : start+length]...)
+		ee, err := f.batchGet(ctx, es[start:start+length]...)
 		if err != nil {
 			return nil, err
 		}
@@ -195,43 +378,90 @@ func (f *Freesia) MGet(es ...*entry.Entry) ([]*entry.Entry, error) {
 }
 
 func (f *Freesia) Del(keys ...string) error {
+	return f.DelContext(context.Background(), keys...)
+}
+
+func (f *Freesia) DelContext(ctx context.Context, keys ...string) error {
+	ctx, span := startSpan(ctx, "Del", keys...)
+	err := f.del(ctx, keys...)
+	endSpan(span, err)
+	return err
+}
+
+func (f *Freesia) del(ctx context.Context, keys ...string) error {
 	if len(keys) == 0 {
 		return nil
 	}
-	_, err := f.store.Del(keys...).Result()
-	if err != nil {
-		return errors.Wrapf(err, "store del, keys = %+v", keys)
+	if f.writeBack != nil && f.breakerOpen() {
+		f.writeBack.queueDel(keys...)
+	} else {
+		_, err := f.storeExec(func() (interface{}, error) {
+			return f.store.WithContext(ctx).Del(keys...).Result()
+		})
+		if err != nil {
+			if f.writeBack == nil {
+				return newError("Del", fmt.Sprintf("%v", keys), LayerStore, err)
+			}
+			f.writeBack.queueDel(keys...)
+		} else if err := f.unregisterTags(ctx, keys...); err != nil {
+			return err
+		}
 	}
 	for _, key := range keys {
 		if err := f.cache.Del(key); err != nil {
-			return errors.Wrapf(err, "delete cache: key = %s", key)
+			return newError("Del", key, LayerLocal, err)
 		}
 	}
 	return nil
 }
 
+// drainWriteBack periodically replays the writes and deletes buffered
+// while the breaker was open, once it has closed again.
+func (f *Freesia) drainWriteBack() {
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for range ticker.C {
+			if f.breakerOpen() {
+				continue
+			}
+			sets, dels := f.writeBack.drain()
+			for _, e := range sets {
+				if err := f.SetContext(context.Background(), e); err != nil {
+					f.metrics.Error(err)
+				}
+			}
+			if len(dels) > 0 {
+				if err := f.DelContext(context.Background(), dels...); err != nil {
+					f.metrics.Error(err)
+				}
+			}
+		}
+	}()
+}
+
 func (f *Freesia) sub() {
 	go func() {
 		pubSub := f.store.Subscribe(channel)
 		defer func() {
 			if err := pubSub.Close(); err != nil {
-				fmt.Printf("pubsub err = %#v", err)
+				f.metrics.Error(newError("sub", "", LayerPubsub, err))
 			}
 		}()
 		for message := range pubSub.Channel() {
 			job := curlew.NewJob()
 			job.Arg = message
 			job.Fn = func(ctx context.Context, arg interface{}) error {
+				_, span := startSpan(ctx, "invalidate")
 				message := arg.(*redis.Message)
-				var keys []string
-				if err := msgpack.Unmarshal([]byte(message.Payload), &keys); err != nil {
+				env, err := decodeInvalidation([]byte(message.Payload))
+				if err != nil {
+					err = newError("sub", "", LayerPubsub, err)
+					endSpan(span, err)
 					return err
 				}
-				for _, key := range keys {
-					if err := f.cache.Del(key); err != nil {
-						fmt.Printf("CacheDeleteKey key = %s, err = %#v", key, err)
-					}
-				}
+				f.applyInvalidation(env)
+				endSpan(span, nil)
 				return nil
 			}
 			f.dispatcher.SubmitAsync(job)
@@ -0,0 +1,243 @@
+package freesia
+
+import (
+	"context"
+
+	"github.com/vmihailenco/msgpack"
+	"github.com/xiaojiaoyu100/freesia/entry"
+)
+
+// invalidationKind identifies how an invalidationEnvelope's payload
+// should be interpreted by the subscriber.
+type invalidationKind string
+
+const (
+	invalidationKeys    invalidationKind = "keys"
+	invalidationTags    invalidationKind = "tags"
+	invalidationPattern invalidationKind = "pattern"
+)
+
+// envelopeVersion lets sub() tell an invalidationEnvelope apart from the
+// raw msgpack-encoded []string payloads Freesia published before this
+// envelope existed, so older and newer publishers can coexist.
+const envelopeVersion = 1
+
+// invalidationEnvelope is the versioned message Freesia publishes on
+// channel to drive local cache invalidation across instances.
+type invalidationEnvelope struct {
+	Version int
+	Kind    invalidationKind
+	Payload []string
+}
+
+// tagSetKey is the Redis set that tracks which keys were tagged with tag.
+func tagSetKey(tag string) string {
+	return "freesia:tag:" + tag
+}
+
+// keyTagsKey is the Redis set that tracks which tags key was registered
+// under, so del can prune key out of those tag sets again.
+func keyTagsKey(key string) string {
+	return "freesia:keytags:" + key
+}
+
+// registerTags adds e.Key to the tag sets for any tags it was set with,
+// and records the reverse mapping so del can undo it later. unregisterTags
+// only ever runs on an explicit Del, so to keep a key that merely expired
+// from lingering in its tag sets forever, each touched set's TTL is
+// refreshed to e.Expiration: a tag shared by entries with varying
+// expirations settles at whichever one registered most recently, which
+// bounds membership growth without needing to track every member's TTL.
+func (f *Freesia) registerTags(ctx context.Context, e *entry.Entry) error {
+	tags := e.Tags()
+	if len(tags) == 0 {
+		return nil
+	}
+	store := f.store.WithContext(ctx)
+	for _, tag := range tags {
+		if err := store.SAdd(tagSetKey(tag), e.Key).Err(); err != nil {
+			return newError("Set", e.Key, LayerStore, err)
+		}
+		if e.Expiration > 0 {
+			if err := store.Expire(tagSetKey(tag), e.Expiration).Err(); err != nil {
+				return newError("Set", e.Key, LayerStore, err)
+			}
+		}
+	}
+	if err := store.SAdd(keyTagsKey(e.Key), interfaceSlice(tags)...).Err(); err != nil {
+		return newError("Set", e.Key, LayerStore, err)
+	}
+	if e.Expiration > 0 {
+		if err := store.Expire(keyTagsKey(e.Key), e.Expiration).Err(); err != nil {
+			return newError("Set", e.Key, LayerStore, err)
+		}
+	}
+	return nil
+}
+
+// unregisterTags removes each key from the tag sets it was registered
+// under, so InvalidateTag stops resolving keys that were deleted
+// without going through InvalidateTag itself.
+func (f *Freesia) unregisterTags(ctx context.Context, keys ...string) error {
+	store := f.store.WithContext(ctx)
+	for _, key := range keys {
+		tags, err := store.SMembers(keyTagsKey(key)).Result()
+		if err != nil {
+			return newError("Del", key, LayerStore, err)
+		}
+		if len(tags) == 0 {
+			continue
+		}
+		for _, tag := range tags {
+			if err := store.SRem(tagSetKey(tag), key).Err(); err != nil {
+				return newError("Del", key, LayerStore, err)
+			}
+		}
+		if err := store.Del(keyTagsKey(key)).Err(); err != nil {
+			return newError("Del", key, LayerStore, err)
+		}
+	}
+	return nil
+}
+
+func interfaceSlice(ss []string) []interface{} {
+	is := make([]interface{}, len(ss))
+	for i, s := range ss {
+		is[i] = s
+	}
+	return is
+}
+
+// InvalidateTag deletes every key tagged with any of tags from the
+// store and the local cache, and broadcasts the invalidation so other
+// instances do the same.
+func (f *Freesia) InvalidateTag(tags ...string) error {
+	return f.InvalidateTagContext(context.Background(), tags...)
+}
+
+// InvalidateTagContext is InvalidateTag with a caller-supplied context.
+func (f *Freesia) InvalidateTagContext(ctx context.Context, tags ...string) error {
+	if len(tags) == 0 {
+		return nil
+	}
+	keys, err := f.resolveTagKeys(ctx, tags)
+	if err != nil {
+		return err
+	}
+	if len(keys) > 0 {
+		if err := f.del(ctx, keys...); err != nil {
+			return err
+		}
+	}
+	tagSetKeys := make([]string, len(tags))
+	for i, tag := range tags {
+		tagSetKeys[i] = tagSetKey(tag)
+	}
+	if err := f.store.WithContext(ctx).Del(tagSetKeys...).Err(); err != nil {
+		return newError("InvalidateTag", "", LayerStore, err)
+	}
+	// Publish the keys we already resolved rather than the tags: by the
+	// time a subscriber would try to resolve the tags itself, the tag
+	// sets deleted above are already gone.
+	return f.publish(ctx, invalidationKeys, keys)
+}
+
+func (f *Freesia) resolveTagKeys(ctx context.Context, tags []string) ([]string, error) {
+	var keys []string
+	for _, tag := range tags {
+		members, err := f.store.WithContext(ctx).SMembers(tagSetKey(tag)).Result()
+		if err != nil {
+			return nil, newError("InvalidateTag", tag, LayerStore, err)
+		}
+		keys = append(keys, members...)
+	}
+	return keys, nil
+}
+
+// InvalidatePattern deletes every store key matching pattern (a redis
+// glob, e.g. "user:123:*"). The calling instance purges its own local
+// cache for every key the scan turns up; other instances receive only
+// the pattern over pubsub and cannot enumerate their local roc.Cache,
+// so they leave their matching entries to expire by their own TTL
+// instead of purging them eagerly.
+func (f *Freesia) InvalidatePattern(pattern string) error {
+	return f.InvalidatePatternContext(context.Background(), pattern)
+}
+
+// InvalidatePatternContext is InvalidatePattern with a caller-supplied context.
+func (f *Freesia) InvalidatePatternContext(ctx context.Context, pattern string) error {
+	store := f.store.WithContext(ctx)
+	iter := store.Scan(0, pattern, 0).Iterator()
+	var keys []string
+	for iter.Next() {
+		key := iter.Val()
+		if err := store.Del(key).Err(); err != nil {
+			return newError("InvalidatePattern", key, LayerStore, err)
+		}
+		keys = append(keys, key)
+	}
+	if err := iter.Err(); err != nil {
+		return newError("InvalidatePattern", pattern, LayerStore, err)
+	}
+	for _, key := range keys {
+		if err := f.cache.Del(key); err != nil {
+			return newError("InvalidatePattern", key, LayerLocal, err)
+		}
+	}
+	return f.publish(ctx, invalidationPattern, []string{pattern})
+}
+
+// publish broadcasts a versioned invalidation envelope on channel.
+func (f *Freesia) publish(ctx context.Context, kind invalidationKind, payload []string) error {
+	b, err := msgpack.Marshal(invalidationEnvelope{
+		Version: envelopeVersion,
+		Kind:    kind,
+		Payload: payload,
+	})
+	if err != nil {
+		return newError("publish", "", LayerPubsub, err)
+	}
+	if err := f.store.WithContext(ctx).Publish(channel, b).Err(); err != nil {
+		return newError("publish", "", LayerPubsub, err)
+	}
+	return nil
+}
+
+// decodeInvalidation parses a pubsub payload as an invalidationEnvelope,
+// falling back to the raw msgpack-encoded []string format Freesia
+// published before the envelope existed.
+func decodeInvalidation(b []byte) (invalidationEnvelope, error) {
+	var env invalidationEnvelope
+	if err := msgpack.Unmarshal(b, &env); err == nil && env.Version == envelopeVersion {
+		return env, nil
+	}
+	var keys []string
+	if err := msgpack.Unmarshal(b, &keys); err != nil {
+		return invalidationEnvelope{}, err
+	}
+	return invalidationEnvelope{Version: envelopeVersion, Kind: invalidationKeys, Payload: keys}, nil
+}
+
+// applyInvalidation carries out the local-cache side effects of a
+// received invalidationEnvelope. InvalidateTagContext publishes
+// invalidationKeys (the already-resolved key list), not
+// invalidationTags, so there's no case here that re-resolves tags on
+// the subscriber: by the time a receiver saw the tag names, the tag
+// sets behind them would already be gone.
+func (f *Freesia) applyInvalidation(env invalidationEnvelope) {
+	switch env.Kind {
+	case invalidationPattern:
+		// No local enumeration primitive; see InvalidatePatternContext.
+	default:
+		f.deleteLocal(env.Payload)
+	}
+}
+
+func (f *Freesia) deleteLocal(keys []string) {
+	f.metrics.PubsubInvalidation(len(keys))
+	for _, key := range keys {
+		if err := f.cache.Del(key); err != nil {
+			f.metrics.Error(newError("sub", key, LayerPubsub, err))
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package freesia
+
+import (
+	"testing"
+	"time"
+
+	"github.com/vmihailenco/msgpack"
+	"github.com/xiaojiaoyu100/roc"
+)
+
+func TestDecodeInvalidationEnvelope(t *testing.T) {
+	b, err := msgpack.Marshal(invalidationEnvelope{
+		Version: envelopeVersion,
+		Kind:    invalidationKeys,
+		Payload: []string{"k1", "k2"},
+	})
+	if err != nil {
+		t.Fatalf("msgpack.Marshal: %v", err)
+	}
+
+	env, err := decodeInvalidation(b)
+	if err != nil {
+		t.Fatalf("decodeInvalidation: %v", err)
+	}
+	if env.Kind != invalidationKeys || len(env.Payload) != 2 {
+		t.Fatalf("got %+v", env)
+	}
+}
+
+// TestDecodeInvalidationLegacyPayload covers the raw []string payloads
+// Freesia published before invalidationEnvelope existed.
+func TestDecodeInvalidationLegacyPayload(t *testing.T) {
+	b, err := msgpack.Marshal([]string{"k1"})
+	if err != nil {
+		t.Fatalf("msgpack.Marshal: %v", err)
+	}
+
+	env, err := decodeInvalidation(b)
+	if err != nil {
+		t.Fatalf("decodeInvalidation: %v", err)
+	}
+	if env.Kind != invalidationKeys || len(env.Payload) != 1 || env.Payload[0] != "k1" {
+		t.Fatalf("got %+v", env)
+	}
+}
+
+// TestApplyInvalidationCrossInstance simulates a second Freesia instance
+// receiving the envelope InvalidateTagContext now publishes: the
+// resolved key list, rather than the tag names it used to publish
+// before the tag sets backing them were deleted. A receiver that still
+// had to resolve tags itself would always see an empty set and leave
+// its local cache stale.
+func TestApplyInvalidationCrossInstance(t *testing.T) {
+	cache, err := roc.New()
+	if err != nil {
+		t.Fatalf("roc.New: %v", err)
+	}
+	if err := cache.Set("k1", []byte("v1"), time.Minute); err != nil {
+		t.Fatalf("cache.Set: %v", err)
+	}
+
+	f := &Freesia{cache: cache, metrics: noopMetrics{}}
+	f.applyInvalidation(invalidationEnvelope{
+		Version: envelopeVersion,
+		Kind:    invalidationKeys,
+		Payload: []string{"k1"},
+	})
+
+	if _, err := cache.Get("k1"); err == nil {
+		t.Fatal("k1 should have been purged from the local cache")
+	}
+}
@@ -0,0 +1,39 @@
+package freesia
+
+// Metrics is the observability hook Freesia reports counters and
+// histograms through. Implementations are expected to be
+// Prometheus-friendly, but the interface itself has no Prometheus
+// dependency.
+type Metrics interface {
+	LocalHit(key string)
+	LocalMiss(key string)
+	StoreHit(key string)
+	StoreMiss(key string)
+	SetLatency(seconds float64)
+	PipelineSize(n int)
+	PubsubInvalidation(n int)
+	AsyncFillQueueDepth(n int)
+	Error(err error)
+}
+
+// WithMetrics installs m as Freesia's Metrics sink.
+func WithMetrics(m Metrics) Setter {
+	return func(f *Freesia) error {
+		f.metrics = m
+		return nil
+	}
+}
+
+type noopMetrics struct{}
+
+func (noopMetrics) LocalHit(string)         {}
+func (noopMetrics) LocalMiss(string)        {}
+func (noopMetrics) StoreHit(string)         {}
+func (noopMetrics) StoreMiss(string)        {}
+func (noopMetrics) SetLatency(float64)      {}
+func (noopMetrics) PipelineSize(int)        {}
+func (noopMetrics) PubsubInvalidation(int)  {}
+func (noopMetrics) AsyncFillQueueDepth(int) {}
+func (noopMetrics) Error(error)             {}
+
+var _ Metrics = noopMetrics{}
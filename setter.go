@@ -0,0 +1,4 @@
+package freesia
+
+// Setter configures a Freesia instance at construction time.
+type Setter func(*Freesia) error
@@ -0,0 +1,18 @@
+package freesia
+
+import (
+	"context"
+
+	"github.com/go-redis/redis"
+)
+
+// Store is the redis client contract that Freesia depends on. It is
+// satisfied by *redis.Client; *redis.ClusterClient is not, since its
+// WithContext returns *redis.ClusterClient rather than *redis.Client,
+// and Go does not allow return-type covariance in interface
+// satisfaction.
+type Store interface {
+	redis.Cmdable
+	WithContext(ctx context.Context) *redis.Client
+	Subscribe(channels ...string) *redis.PubSub
+}
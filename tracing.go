@@ -0,0 +1,33 @@
+package freesia
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("github.com/xiaojiaoyu100/freesia")
+
+// startSpan opens an OpenTelemetry span for a Freesia operation,
+// tagging it with the key(s) it operates on where that's cheap to do.
+func startSpan(ctx context.Context, op string, keys ...string) (context.Context, trace.Span) {
+	ctx, span := tracer.Start(ctx, "freesia."+op)
+	if len(keys) == 1 {
+		span.SetAttributes(attribute.String("freesia.key", keys[0]))
+	} else if len(keys) > 1 {
+		span.SetAttributes(attribute.StringSlice("freesia.keys", keys))
+	}
+	return ctx, span
+}
+
+// endSpan records err on span, if any, and closes it.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}